@@ -0,0 +1,608 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Sample storage_objects is a tool to manage Google Cloud Storage objects by
+// using Google Storage API.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+func main() {
+	// none, functions are called from tests.
+}
+
+func write(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	wc := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	wc.Write([]byte("Hello\nworld"))
+	return wc.Close()
+}
+
+// writeWithProgress uploads data to bucket/object using the resumable
+// upload protocol in chunkSize-sized chunks, reporting progress through
+// progress as bytes are sent and retrying transient errors with
+// exponential backoff.
+func writeWithProgress(client *storage.Client, bucket, object string, data []byte, chunkSize int, progress func(int64)) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*10)
+	defer cancel()
+
+	const maxAttempts = 5
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+		w.ChunkSize = chunkSize
+		w.ProgressFunc = progress
+
+		if _, werr := w.Write(data); werr != nil {
+			err = werr
+		} else {
+			err = w.Close()
+		}
+		if err == nil {
+			return nil
+		}
+		if !isTransientErr(err) || attempt == maxAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// isTransientErr reports whether err is a temporary condition worth
+// retrying, such as a 5xx response or a rate limit from GCS.
+func isTransientErr(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Temporary()
+	}
+	return false
+}
+
+func list(w io.Writer, client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	it := client.Bucket(bucket).Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, attrs.Name)
+	}
+	return nil
+}
+
+func listByPrefix(w io.Writer, client *storage.Client, bucket, prefix, delim string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{
+		Prefix:    prefix,
+		Delimiter: delim,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, attrs.Name)
+	}
+	return nil
+}
+
+func read(client *storage.Client, bucket, object string) ([]byte, error) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// downloadSliced downloads bucket/object into dst using workers concurrent
+// Range reads, each responsible for one slice of the object, writing
+// directly to its slice's offset in dst. This can give considerably higher
+// throughput than a single streaming read for large objects.
+func downloadSliced(client *storage.Client, bucket, object string, dst io.WriterAt, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("downloadSliced: workers must be at least 1, got %d", workers)
+	}
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*10)
+	defer cancel()
+
+	o := client.Bucket(bucket).Object(object)
+	objAttrs, err := o.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	size := objAttrs.Size
+	sliceSize := size / int64(workers)
+	if sliceSize == 0 {
+		sliceSize = size
+		workers = 1
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < workers; i++ {
+		offset := int64(i) * sliceSize
+		length := sliceSize
+		if i == workers-1 {
+			length = size - offset // the last slice absorbs the remainder.
+		}
+
+		g.Go(func() error {
+			r, err := o.NewRangeReader(ctx, offset, length)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			buf := make([]byte, 32*1024)
+			var written int64
+			for {
+				n, rerr := r.Read(buf)
+				if n > 0 {
+					if _, werr := dst.WriteAt(buf[:n], offset+written); werr != nil {
+						return werr
+					}
+					written += int64(n)
+				}
+				if rerr == io.EOF {
+					return nil
+				}
+				if rerr != nil {
+					return rerr
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// enableBucketVersioning turns on object versioning for bucket, so that
+// overwriting or deleting an object keeps the prior generation around as a
+// noncurrent version instead of discarding it.
+func enableBucketVersioning(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := client.Bucket(bucket).Update(ctx, storage.BucketAttrsToUpdate{VersioningEnabled: true})
+	return err
+}
+
+// disableBucketVersioning turns off object versioning for bucket. Existing
+// noncurrent versions are left in place; only future overwrites stop being
+// versioned.
+func disableBucketVersioning(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := client.Bucket(bucket).Update(ctx, storage.BucketAttrsToUpdate{VersioningEnabled: false})
+	return err
+}
+
+// setLifecycleRules replaces bucket's lifecycle configuration with rules.
+func setLifecycleRules(client *storage.Client, bucket string, rules []storage.LifecycleRule) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := client.Bucket(bucket).Update(ctx, storage.BucketAttrsToUpdate{
+		Lifecycle: &storage.Lifecycle{Rules: rules},
+	})
+	return err
+}
+
+// listObjectVersions writes every generation of every object under bucket,
+// including noncurrent versions, to w.
+func listObjectVersions(w io.Writer, client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s (generation %d)\n", attrs.Name, attrs.Generation)
+	}
+	return nil
+}
+
+func attrs(client *storage.Client, bucket, object string) (*storage.ObjectAttrs, error) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	o := client.Bucket(bucket).Object(object)
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func makePublic(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	acl := client.Bucket(bucket).Object(object).ACL()
+	return acl.Set(ctx, storage.AllUsers, storage.RoleReader)
+}
+
+// generateSignedGetURL returns a V4 signed URL granting GET access to
+// bucket/object until expires, signed with the service account key in
+// keyFile.
+func generateSignedGetURL(keyFile, bucket, object string, expires time.Time) (string, error) {
+	opts, err := signedURLOptionsFromKeyFile(keyFile, http.MethodGet, expires)
+	if err != nil {
+		return "", err
+	}
+	return storage.SignedURL(bucket, object, opts)
+}
+
+// generateSignedPutURL returns a V4 signed URL granting PUT access to
+// bucket/object until expires, signed with the service account key in
+// keyFile. contentType and headers, if set, must also be sent by the
+// caller performing the PUT, since they're part of what was signed.
+func generateSignedPutURL(keyFile, bucket, object, contentType string, headers []string, expires time.Time) (string, error) {
+	opts, err := signedURLOptionsFromKeyFile(keyFile, http.MethodPut, expires)
+	if err != nil {
+		return "", err
+	}
+	opts.ContentType = contentType
+	opts.Headers = headers
+	return storage.SignedURL(bucket, object, opts)
+}
+
+// generateSignedResumablePutURL is like generateSignedPutURL, but signs the
+// POST request that starts a resumable upload session rather than a single
+// PUT, so the caller can upload data of unknown or very large size in
+// chunks against the session URI returned in the response's Location
+// header.
+func generateSignedResumablePutURL(keyFile, bucket, object, contentType string, expires time.Time) (string, error) {
+	opts, err := signedURLOptionsFromKeyFile(keyFile, http.MethodPost, expires)
+	if err != nil {
+		return "", err
+	}
+	opts.ContentType = contentType
+	opts.Headers = []string{"x-goog-resumable:start"}
+	return storage.SignedURL(bucket, object, opts)
+}
+
+// signedURLOptionsFromKeyFile builds the common V4 SignedURLOptions shared
+// by the generateSigned*URL samples, reading the signing credentials out
+// of a service account JSON key file.
+func signedURLOptionsFromKeyFile(keyFile, method string, expires time.Time) (*storage.SignedURLOptions, error) {
+	jsonKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile: %v", err)
+	}
+	conf, err := google.JWTConfigFromJSON(jsonKey)
+	if err != nil {
+		return nil, fmt.Errorf("google.JWTConfigFromJSON: %v", err)
+	}
+	return &storage.SignedURLOptions{
+		Scheme:         storage.SigningSchemeV4,
+		Method:         method,
+		GoogleAccessID: conf.Email,
+		PrivateKey:     conf.PrivateKey,
+		Expires:        expires,
+	}, nil
+}
+
+func move(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	dstObject := object + "-rename"
+	src := client.Bucket(bucket).Object(object)
+	dst := client.Bucket(bucket).Object(dstObject)
+
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return err
+	}
+	return src.Delete(ctx)
+}
+
+func copyToBucket(client *storage.Client, dstBucket, srcBucket, srcObject string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	dstObject := srcObject + "-copy"
+	src := client.Bucket(srcBucket).Object(srcObject)
+	dst := client.Bucket(dstBucket).Object(dstObject)
+
+	_, err := dst.CopierFrom(src).Run(ctx)
+	return err
+}
+
+// compose concatenates srcObjects, in order, into dstObject using
+// server-side composition, so the data never has to be downloaded and
+// re-uploaded by the caller. Up to 32 source objects may be composed in a
+// single call.
+func compose(client *storage.Client, bucket, dstObject string, srcObjects ...string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	b := client.Bucket(bucket)
+	var srcs []*storage.ObjectHandle
+	for _, src := range srcObjects {
+		srcs = append(srcs, b.Object(src))
+	}
+
+	dst := b.Object(dstObject)
+	_, err := dst.ComposerFrom(srcs...).Run(ctx)
+	return err
+}
+
+// composeIfGenerationMatch is like compose, but only writes dstObject if
+// its current generation still matches dstGeneration, guarding against a
+// concurrent writer clobbering it between read and compose.
+func composeIfGenerationMatch(client *storage.Client, bucket, dstObject string, dstGeneration int64, srcObjects ...string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	b := client.Bucket(bucket)
+	var srcs []*storage.ObjectHandle
+	for _, src := range srcObjects {
+		srcs = append(srcs, b.Object(src))
+	}
+
+	dst := b.Object(dstObject).If(storage.Conditions{GenerationMatch: dstGeneration})
+	_, err := dst.ComposerFrom(srcs...).Run(ctx)
+	return err
+}
+
+// composeEncrypted is like compose, but for source objects protected by a
+// customer-supplied encryption key. Each source must have been written
+// with key, and the composed destination is encrypted with the same key.
+func composeEncrypted(client *storage.Client, bucket, dstObject string, key []byte, srcObjects ...string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	b := client.Bucket(bucket)
+	var srcs []*storage.ObjectHandle
+	for _, src := range srcObjects {
+		srcs = append(srcs, b.Object(src))
+	}
+
+	dst := b.Object(dstObject).Key(key)
+	_, err := dst.ComposerFrom(srcs...).Run(ctx)
+	return err
+}
+
+func delete(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	o := client.Bucket(bucket).Object(object)
+	return o.Delete(ctx)
+}
+
+func addBucketACL(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bucketACL := client.Bucket(bucket).ACL()
+	return bucketACL.Set(ctx, storage.AllAuthenticatedUsers, storage.RoleReader)
+}
+
+func addDefaultBucketACL(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	defaultACL := client.Bucket(bucket).DefaultObjectACL()
+	return defaultACL.Set(ctx, storage.AllAuthenticatedUsers, storage.RoleReader)
+}
+
+func bucketACL(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	rules, err := client.Bucket(bucket).ACL().List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		fmt.Printf("ACL rule: %v\n", rule)
+	}
+	return nil
+}
+
+func bucketACLFiltered(client *storage.Client, bucket string, entity storage.ACLEntity) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	rules, err := client.Bucket(bucket).ACL().List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Entity == entity {
+			fmt.Printf("ACL rule role: %v\n", rule.Role)
+		}
+	}
+	return nil
+}
+
+func deleteDefaultBucketACL(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	return client.Bucket(bucket).DefaultObjectACL().Delete(ctx, storage.AllAuthenticatedUsers)
+}
+
+func deleteBucketACL(client *storage.Client, bucket string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	return client.Bucket(bucket).ACL().Delete(ctx, storage.AllAuthenticatedUsers)
+}
+
+func addObjectACL(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	acl := client.Bucket(bucket).Object(object).ACL()
+	return acl.Set(ctx, storage.AllAuthenticatedUsers, storage.RoleReader)
+}
+
+func objectACL(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	rules, err := client.Bucket(bucket).Object(object).ACL().List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		fmt.Printf("ACL rule: %v\n", rule)
+	}
+	return nil
+}
+
+func objectACLFiltered(client *storage.Client, bucket, object string, entity storage.ACLEntity) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	rules, err := client.Bucket(bucket).Object(object).ACL().List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Entity == entity {
+			fmt.Printf("ACL rule role: %v\n", rule.Role)
+		}
+	}
+	return nil
+}
+
+func deleteObjectACL(client *storage.Client, bucket, object string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	return client.Bucket(bucket).Object(object).ACL().Delete(ctx, storage.AllAuthenticatedUsers)
+}
+
+func writeEncryptedObject(client *storage.Client, bucket, object string, secretKey []byte) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	obj := client.Bucket(bucket).Object(object).Key(secretKey)
+	w := obj.NewWriter(ctx)
+	if _, err := w.Write([]byte("top secret")); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func writeWithKMSKey(client *storage.Client, bucket, object, keyName string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	obj := client.Bucket(bucket).Object(object)
+	w := obj.NewWriter(ctx)
+	w.KMSKeyName = keyName
+	if _, err := w.Write([]byte("top secret")); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func readEncryptedObject(client *storage.Client, bucket, object string, secretKey []byte) ([]byte, error) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	obj := client.Bucket(bucket).Object(object).Key(secretKey)
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func rotateEncryptionKey(client *storage.Client, bucket, object string, oldKey, newKey []byte) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	src := client.Bucket(bucket).Object(object).Key(oldKey)
+	dst := client.Bucket(bucket).Object(object).Key(newKey)
+
+	_, err := dst.CopierFrom(src).Run(ctx)
+	return err
+}
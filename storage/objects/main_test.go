@@ -6,37 +6,106 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"flag"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 
+	"cloud.google.com/go/httpreplay"
 	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
 
 	"github.com/GoogleCloudPlatform/golang-samples/internal/testutil"
 )
 
-func TestObjects(t *testing.T) {
-	tc := testutil.SystemTest(t)
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+// record runs TestObjects against a live GCS project and writes its RPCs to
+// replayFilename instead of replaying them. Once replayFilename is checked
+// in, contributors without GCP credentials can run `go test` hermetically
+// against it; until then, TestObjects falls back to running against a live
+// project like it always has, gated by testutil.SystemTest.
+var record = flag.Bool("record", false, "record RPCs to "+replayFilename+" against a live GCS project")
+
+const replayFilename = "storage.replay"
+
+// newReplayableClient returns a storage client for TestObjects to use, along
+// with the project ID to build bucket names from and a cleanup func that
+// must run after the test finishes. With -record it records real RPCs
+// against a live project. Otherwise, if replayFilename has been checked in,
+// it replays those RPCs against a synthetic project ID; if not, it falls
+// back to a live client gated by testutil.SystemTest, same as before replay
+// support was added.
+func newReplayableClient(ctx context.Context, t *testing.T) (client *storage.Client, projectID string, cleanup func()) {
+	if *record {
+		tc := testutil.SystemTest(t)
+		rec, err := httpreplay.NewRecorder(replayFilename, nil)
+		if err != nil {
+			t.Fatalf("httpreplay.NewRecorder: %v", err)
+		}
+		hc, err := rec.Client(ctx)
+		if err != nil {
+			t.Fatalf("rec.Client: %v", err)
+		}
+		client, err = storage.NewClient(ctx, option.WithHTTPClient(hc))
+		if err != nil {
+			t.Fatalf("storage.NewClient: %v", err)
+		}
+		return client, tc.ProjectID, func() {
+			if err := rec.Close(); err != nil {
+				t.Errorf("rec.Close: %v", err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(replayFilename); os.IsNotExist(err) {
+		tc := testutil.SystemTest(t)
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			t.Fatalf("storage.NewClient: %v", err)
+		}
+		return client, tc.ProjectID, func() {}
+	}
+	rep, err := httpreplay.NewReplayer(replayFilename)
+	if err != nil {
+		t.Fatalf("httpreplay.NewReplayer: %v", err)
+	}
+	hc, err := rep.Client(ctx)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatalf("rep.Client: %v", err)
 	}
+	client, err = storage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatalf("storage.NewClient: %v", err)
+	}
+	return client, "my-project-id", func() {
+		if err := rep.Close(); err != nil {
+			t.Errorf("rep.Close: %v", err)
+		}
+	}
+}
+
+func TestObjects(t *testing.T) {
+	ctx := context.Background()
+	client, projectID, cleanup := newReplayableClient(ctx, t)
+	defer cleanup()
 
 	var (
-		bucket    = tc.ProjectID + "-samples-object-bucket-1"
-		dstBucket = tc.ProjectID + "-samples-object-bucket-2"
+		bucket    = projectID + "-samples-object-bucket-1"
+		dstBucket = projectID + "-samples-object-bucket-2"
 
 		object1 = "foo.txt"
 		object2 = "foo/a.txt"
 	)
 
-	cleanBucket(t, ctx, client, tc.ProjectID, bucket)
-	cleanBucket(t, ctx, client, tc.ProjectID, dstBucket)
+	cleanBucket(t, ctx, client, projectID, bucket)
+	cleanBucket(t, ctx, client, projectID, dstBucket)
 
 	if err := write(client, bucket, object1); err != nil {
 		t.Fatalf("write(%q): %v", object1, err)
@@ -74,6 +143,132 @@ func TestObjects(t *testing.T) {
 		}
 	}
 
+	{
+		const progressObject = "progress.bin"
+		contents := bytes.Repeat([]byte("0123456789"), 1<<19) // 5MB, enough to span several 1MB chunks.
+		var progressCalls int32
+
+		if err := writeWithProgress(client, bucket, progressObject, contents, 1<<20, func(bytesWritten int64) {
+			atomic.AddInt32(&progressCalls, 1)
+		}); err != nil {
+			t.Fatalf("writeWithProgress: %v", err)
+		}
+		if calls := atomic.LoadInt32(&progressCalls); calls < 2 {
+			t.Errorf("writeWithProgress: ProgressFunc fired %d times; want at least 2", calls)
+		}
+
+		progressAttrs, err := attrs(client, bucket, progressObject)
+		if err != nil {
+			t.Fatalf("attrs(%q): %v", progressObject, err)
+		}
+		if got, want := progressAttrs.CRC32C, crc32.Checksum(contents, crc32.MakeTable(crc32.Castagnoli)); got != want {
+			t.Errorf("writeWithProgress: CRC32C = %d; want %d", got, want)
+		}
+		if err := delete(client, bucket, progressObject); err != nil {
+			t.Errorf("cannot to delete object: %v", err)
+		}
+	}
+
+	{
+		const (
+			part1     = "compose-part-1.txt"
+			part2     = "compose-part-2.txt"
+			composed  = "compose-dst.txt"
+			encrypted = "compose-dst-encrypted.txt"
+		)
+		if err := write(client, bucket, part1); err != nil {
+			t.Fatalf("write(%q): %v", part1, err)
+		}
+		if err := write(client, bucket, part2); err != nil {
+			t.Fatalf("write(%q): %v", part2, err)
+		}
+
+		if err := compose(client, bucket, composed, part1, part2); err != nil {
+			t.Fatalf("compose: %v", err)
+		}
+		got, err := read(client, bucket, composed)
+		if err != nil {
+			t.Fatalf("cannot read composed object: %v", err)
+		}
+		if want := "Hello\nworldHello\nworld"; string(got) != want {
+			t.Errorf("compose: content = %q; want %q", got, want)
+		}
+
+		composedAttrs, err := attrs(client, bucket, composed)
+		if err != nil {
+			t.Fatalf("attrs(%q): %v", composed, err)
+		}
+		if err := composeIfGenerationMatch(client, bucket, composed, composedAttrs.Generation, part1, part2); err != nil {
+			t.Errorf("composeIfGenerationMatch: %v", err)
+		}
+		if err := composeIfGenerationMatch(client, bucket, composed, composedAttrs.Generation, part1, part2); err == nil {
+			t.Error("composeIfGenerationMatch: want error on stale generation, got nil")
+		}
+
+		encKey := []byte("my-secret-AES-256-encryption-key")
+		if err := writeEncryptedObject(client, bucket, part1, encKey); err != nil {
+			t.Fatalf("writeEncryptedObject(%q): %v", part1, err)
+		}
+		if err := writeEncryptedObject(client, bucket, part2, encKey); err != nil {
+			t.Fatalf("writeEncryptedObject(%q): %v", part2, err)
+		}
+		if err := composeEncrypted(client, bucket, encrypted, encKey, part1, part2); err != nil {
+			t.Fatalf("composeEncrypted: %v", err)
+		}
+		gotEncrypted, err := readEncryptedObject(client, bucket, encrypted, encKey)
+		if err != nil {
+			t.Fatalf("cannot read encrypted composed object: %v", err)
+		}
+		if want := "top secrettop secret"; string(gotEncrypted) != want {
+			t.Errorf("composeEncrypted: content = %q; want %q", gotEncrypted, want)
+		}
+
+		for _, o := range []string{part1, part2, composed, encrypted} {
+			if err := delete(client, bucket, o); err != nil {
+				t.Errorf("cannot to delete object: %v", err)
+			}
+		}
+	}
+
+	{
+		const slicedObject = "sliced-download.bin"
+		contents := bytes.Repeat([]byte("0123456789"), 5<<20) // 50MB, enough to span many slices.
+		if err := writeWithProgress(client, bucket, slicedObject, contents, 1<<20, nil); err != nil {
+			t.Fatalf("writeWithProgress(%q): %v", slicedObject, err)
+		}
+
+		dst, err := ioutil.TempFile("", "sliced-download")
+		if err != nil {
+			t.Fatalf("ioutil.TempFile: %v", err)
+		}
+		defer os.Remove(dst.Name())
+		defer dst.Close()
+
+		if err := downloadSliced(client, bucket, slicedObject, dst, 0); err == nil {
+			t.Error("downloadSliced: want error for workers=0, got nil")
+		}
+
+		// Throughput improvement over a single-stream read isn't asserted
+		// here: it depends on network conditions that are too unreliable to
+		// gate a test on, so this only checks that the sliced download
+		// reassembles the object correctly.
+		if err := downloadSliced(client, bucket, slicedObject, dst, 8); err != nil {
+			t.Fatalf("downloadSliced: %v", err)
+		}
+
+		got, err := ioutil.ReadFile(dst.Name())
+		if err != nil {
+			t.Fatalf("cannot read downloaded file: %v", err)
+		}
+		if got, want := crc32.Checksum(got, crc32.MakeTable(crc32.Castagnoli)), crc32.Checksum(contents, crc32.MakeTable(crc32.Castagnoli)); got != want {
+			t.Errorf("downloadSliced: CRC32C = %d; want %d", got, want)
+		}
+
+		if err := delete(client, bucket, slicedObject); err != nil {
+			t.Errorf("cannot to delete object: %v", err)
+		}
+	}
+
 	data, err := read(client, bucket, object1)
 	if err != nil {
 		t.Fatalf("cannot read object: %v", err)
@@ -203,3 +398,214 @@ func cleanBucket(t *testing.T, ctx context.Context, client *storage.Client, proj
 		t.Fatalf("Bucket.Create(%q): %v", bucket, err)
 	}
 }
+
+func TestBucketVersioningAndLifecycle(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := tc.ProjectID + "-samples-object-bucket-versioning"
+	const object = "versioned.txt"
+
+	cleanBucket(t, ctx, client, tc.ProjectID, bucket)
+
+	if err := enableBucketVersioning(client, bucket); err != nil {
+		t.Fatalf("enableBucketVersioning: %v", err)
+	}
+
+	if err := write(client, bucket, object); err != nil {
+		t.Fatalf("write(%q): %v", object, err)
+	}
+	if err := write(client, bucket, object); err != nil {
+		t.Fatalf("write(%q): %v", object, err)
+	}
+	if err := write(client, bucket, object); err != nil {
+		t.Fatalf("write(%q): %v", object, err)
+	}
+
+	var buf bytes.Buffer
+	if err := listObjectVersions(&buf, client, bucket); err != nil {
+		t.Fatalf("listObjectVersions: %v", err)
+	}
+	if got := strings.Count(buf.String(), object); got != 3 {
+		t.Errorf("listObjectVersions: found %d generations of %q; want 3\n%s", got, object, buf.String())
+	}
+
+	rules := []storage.LifecycleRule{
+		{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: 30, Liveness: storage.Archived},
+		},
+		{
+			Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "NEARLINE"},
+			Condition: storage.LifecycleCondition{AgeInDays: 90},
+		},
+	}
+	if err := setLifecycleRules(client, bucket, rules); err != nil {
+		t.Fatalf("setLifecycleRules: %v", err)
+	}
+
+	attrs, err := client.Bucket(bucket).Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Bucket.Attrs: %v", err)
+	}
+	if got := len(attrs.Lifecycle.Rules); got != len(rules) {
+		t.Errorf("bucket has %d lifecycle rules; want %d", got, len(rules))
+	}
+
+	if err := disableBucketVersioning(client, bucket); err != nil {
+		t.Errorf("disableBucketVersioning: %v", err)
+	}
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Versions: true})
+	for {
+		objAttrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Bucket.Objects: %v", err)
+		}
+		if err := client.Bucket(bucket).Object(objAttrs.Name).Generation(objAttrs.Generation).Delete(ctx); err != nil {
+			t.Errorf("cannot to delete object generation: %v", err)
+		}
+	}
+
+	testutil.Retry(t, 10, time.Second, func(r *testutil.R) {
+		if err := client.Bucket(bucket).Delete(ctx); err != nil {
+			r.Errorf("cleanup of bucket failed: %v", err)
+		}
+	})
+}
+
+func TestGenerateSignedURLs(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if keyFile == "" {
+		t.Skip("GOOGLE_APPLICATION_CREDENTIALS must point at a service account JSON key file")
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := tc.ProjectID + "-samples-object-bucket-signed-url"
+	expires := time.Now().Add(10 * time.Minute)
+
+	cleanBucket(t, ctx, client, tc.ProjectID, bucket)
+
+	const getObject = "signed-url-get.txt"
+	if err := write(client, bucket, getObject); err != nil {
+		t.Fatalf("write(%q): %v", getObject, err)
+	}
+
+	getURL, err := generateSignedGetURL(keyFile, bucket, getObject, expires)
+	if err != nil {
+		t.Fatalf("generateSignedGetURL: %v", err)
+	}
+	resp, err := http.Get(getURL)
+	if err != nil {
+		t.Fatalf("http.Get(signed GET url): %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed GET url: status = %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading signed GET response: %v", err)
+	}
+	if want := "Hello\nworld"; string(got) != want {
+		t.Errorf("signed GET url contents = %q; want %q", got, want)
+	}
+
+	const putContents = "Hello\nsigned world"
+	const putObject = "signed-url-put.txt"
+	putURL, err := generateSignedPutURL(keyFile, bucket, putObject, "text/plain", nil, expires)
+	if err != nil {
+		t.Fatalf("generateSignedPutURL: %v", err)
+	}
+	putReq, err := http.NewRequest(http.MethodPut, putURL, strings.NewReader(putContents))
+	if err != nil {
+		t.Fatalf("http.NewRequest(PUT): %v", err)
+	}
+	putReq.Header.Set("Content-Type", "text/plain")
+	putResp, err := http.DefaultClient.Do(putReq)
+	if err != nil {
+		t.Fatalf("signed PUT: %v", err)
+	}
+	putResp.Body.Close()
+	if putResp.StatusCode != http.StatusOK {
+		t.Fatalf("signed PUT url: status = %d; want %d", putResp.StatusCode, http.StatusOK)
+	}
+
+	putData, err := read(client, bucket, putObject)
+	if err != nil {
+		t.Fatalf("cannot read object uploaded via signed PUT url: %v", err)
+	}
+	if string(putData) != putContents {
+		t.Errorf("signed PUT url contents = %q; want %q", putData, putContents)
+	}
+
+	const resumableObject = "signed-url-resumable.txt"
+	resumableURL, err := generateSignedResumablePutURL(keyFile, bucket, resumableObject, "text/plain", expires)
+	if err != nil {
+		t.Fatalf("generateSignedResumablePutURL: %v", err)
+	}
+	startReq, err := http.NewRequest(http.MethodPost, resumableURL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(POST): %v", err)
+	}
+	startReq.Header.Set("Content-Type", "text/plain")
+	startReq.Header.Set("x-goog-resumable", "start")
+	startResp, err := http.DefaultClient.Do(startReq)
+	if err != nil {
+		t.Fatalf("starting resumable session: %v", err)
+	}
+	startResp.Body.Close()
+	if startResp.StatusCode != http.StatusCreated {
+		t.Fatalf("starting resumable session: status = %d; want %d", startResp.StatusCode, http.StatusCreated)
+	}
+	sessionURI := startResp.Header.Get("Location")
+	if sessionURI == "" {
+		t.Fatal("resumable session response missing Location header")
+	}
+
+	uploadReq, err := http.NewRequest(http.MethodPut, sessionURI, strings.NewReader(putContents))
+	if err != nil {
+		t.Fatalf("http.NewRequest(PUT session): %v", err)
+	}
+	uploadResp, err := http.DefaultClient.Do(uploadReq)
+	if err != nil {
+		t.Fatalf("uploading to resumable session: %v", err)
+	}
+	uploadResp.Body.Close()
+	if uploadResp.StatusCode != http.StatusOK {
+		t.Fatalf("uploading to resumable session: status = %d; want %d", uploadResp.StatusCode, http.StatusOK)
+	}
+
+	resumableData, err := read(client, bucket, resumableObject)
+	if err != nil {
+		t.Fatalf("cannot read object uploaded via resumable signed url: %v", err)
+	}
+	if string(resumableData) != putContents {
+		t.Errorf("resumable signed url contents = %q; want %q", resumableData, putContents)
+	}
+
+	for _, o := range []string{getObject, putObject, resumableObject} {
+		if err := delete(client, bucket, o); err != nil {
+			t.Errorf("cannot to delete object: %v", err)
+		}
+	}
+
+	testutil.Retry(t, 10, time.Second, func(r *testutil.R) {
+		if err := client.Bucket(bucket).Delete(ctx); err != nil {
+			r.Errorf("cleanup of bucket failed: %v", err)
+		}
+	})
+}